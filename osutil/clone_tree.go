@@ -0,0 +1,151 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package osutil
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// CloneOptions controls how CloneTree clones a directory tree.
+type CloneOptions struct {
+	// DisableReflink forces CloneTree to skip the copy-on-write fast path
+	// and go straight to a full recursive copy, as if the underlying
+	// filesystem didn't support cloning. Useful for tests that need to
+	// exercise the fallback path on a filesystem that does support it.
+	DisableReflink bool
+}
+
+// CloneTree copies the file tree rooted at src onto dst. Where the
+// underlying filesystem supports it (btrfs, xfs with reflink=1, zfs with
+// block cloning) regular files are cloned copy-on-write instead of being
+// copied byte for byte, so the two trees share extents until one of them
+// is written to. On Linux, hardlinks within src are preserved in dst, and
+// every entry's owner is preserved too (not just its mode), since this is
+// used to copy per-user snap data that must stay owned by that user; on
+// other systems neither is (see clone_tree_unsupported.go). usedReflink
+// reports whether the fast path was taken for at least one file; callers
+// should not rely on it for anything other than logging/metrics, since a
+// tree can be partially cloned (e.g. a cross-device mount point nested
+// inside src falls back to a regular copy for just that subtree).
+//
+// dst must not exist yet. On any error, CloneTree makes no attempt to
+// clean up a partially written dst; callers that need atomicity should
+// clone into a temporary sibling and rename it into place.
+func CloneTree(src, dst string, opts CloneOptions) (usedReflink bool, err error) {
+	return cloneTree(src, dst, opts)
+}
+
+// copyTreeFallback is the plain recursive copy of the whole tree used when
+// the fast path isn't available at all (unsupported OS,
+// CloneOptions.DisableReflink, or src and dst on different devices). A
+// single file whose clone attempt fails is not copied through here but
+// by cloneFile's own fallback to copyRegularFile.
+// Hardlinks within src are preserved via the dev/inode -> dst path map
+// that the caller threads through the walk.
+func copyTreeFallback(src, dst string, hardlinks map[hardlinkKey]string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		dstPath := filepath.Join(dst, rel)
+
+		switch {
+		case info.IsDir():
+			if err := os.MkdirAll(dstPath, info.Mode().Perm()); err != nil {
+				return err
+			}
+			return chownLike(dstPath, info)
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(target, dstPath); err != nil {
+				return err
+			}
+			return chownLike(dstPath, info)
+		case !info.Mode().IsRegular():
+			// sockets, devices, fifos: data dirs shouldn't contain these,
+			// skip rather than fail the whole tree
+			return nil
+		}
+
+		if hardlinks != nil {
+			if key, ok := hardlinkKeyOf(info); ok {
+				if existing, ok := hardlinks[key]; ok {
+					return os.Link(existing, dstPath)
+				}
+				hardlinks[key] = dstPath
+			}
+		}
+
+		if err := copyRegularFile(path, dstPath, info.Mode().Perm()); err != nil {
+			return err
+		}
+		return chownLike(dstPath, info)
+	})
+}
+
+func copyRegularFile(src, dst string, perm os.FileMode) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// hardlinkKey identifies a file by device and inode, so that two paths
+// under src that are hardlinked to each other end up hardlinked under
+// dst too, instead of becoming two independent copies. hardlinkKeyOf,
+// which fills one in, is platform-specific (see clone_tree_linux.go and
+// clone_tree_unsupported.go) since it reads the device/inode out of the
+// OS-specific os.FileInfo.Sys() value.
+type hardlinkKey struct {
+	dev, ino uint64
+}
+
+// chownLike sets dst's owner to match info, the os.FileInfo of the
+// source entry CloneTree/copyTreeFallback just recreated at dst. Without
+// this every path CloneTree creates ends up owned by whoever's running
+// it (root, for snapd) instead of the original owner, which would leave
+// a refreshed snap unable to read or write its own $SNAP_USER_DATA. Like
+// hardlinkKeyOf, chownLike is platform-specific (see clone_tree_linux.go
+// and clone_tree_unsupported.go) since the owner is read out of the
+// OS-specific os.FileInfo.Sys() value.
@@ -0,0 +1,220 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+//go:build linux
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package osutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// hardlinkKeyOf reads the device/inode pair out of info's platform-
+// specific Sys() value. It only reports ok for files with more than one
+// link, since that's the only case copyTreeFallback/cloneTree need to
+// treat specially.
+func hardlinkKeyOf(info os.FileInfo) (hardlinkKey, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return hardlinkKey{}, false
+	}
+	return hardlinkKey{dev: uint64(st.Dev), ino: st.Ino}, true
+}
+
+// chownLike sets dst's owner to match info's, reading the uid/gid out of
+// the same *syscall.Stat_t that hardlinkKeyOf reads the device/inode
+// from. It's used on both the reflink and fallback-copy paths, since
+// neither FICLONE, copy_file_range nor a plain io.Copy preserve
+// ownership on their own.
+func chownLike(dst string, info os.FileInfo) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return os.Lchown(dst, int(st.Uid), int(st.Gid))
+}
+
+// sameDevice reports whether a and b live on the same mounted
+// filesystem, which is a precondition for cloning (or hardlinking)
+// between them.
+func sameDevice(a, b string) (bool, error) {
+	fiA, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	fiB, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+	stA, ok := fiA.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false, fmt.Errorf("cannot determine device of %q", a)
+	}
+	stB, ok := fiB.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false, fmt.Errorf("cannot determine device of %q", b)
+	}
+	return stA.Dev == stB.Dev, nil
+}
+
+// reflinkCapableMagic lists the statfs f_type magic numbers of
+// filesystems known to support FICLONE/copy_file_range extent sharing.
+// zfs doesn't have a stable public magic number and is detected instead
+// by simply trying the clone and trusting the EOPNOTSUPP/EXDEV fallback.
+var reflinkCapableMagic = map[int64]bool{
+	unix.BTRFS_SUPER_MAGIC: true,
+	unix.XFS_SUPER_MAGIC:   true,
+}
+
+func reflinkMaybeSupported(dir string) bool {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		// can't tell, let the per-file ioctl attempt decide
+		return true
+	}
+	if reflinkCapableMagic[int64(st.Type)] {
+		return true
+	}
+	// unknown magic (zfs and friends): don't rule it out, the ioctl
+	// attempt below is authoritative either way
+	return true
+}
+
+// cloneTree walks src, recreating directories and symlinks as-is and
+// cloning regular files onto dst with FICLONE, falling back to a regular
+// copy per file when cloning isn't possible (different filesystem inside
+// src, filesystem doesn't support it, or the two trees are on different
+// devices altogether).
+func cloneTree(src, dst string, opts CloneOptions) (usedReflink bool, err error) {
+	if opts.DisableReflink {
+		return false, copyTreeFallback(src, dst, make(map[hardlinkKey]string))
+	}
+
+	if same, err := sameDevice(filepath.Dir(src), filepath.Dir(dst)); err != nil || !same {
+		// cross-device: reflinking is never possible, don't bother
+		// probing the filesystem type
+		return false, copyTreeFallback(src, dst, make(map[hardlinkKey]string))
+	}
+
+	if !reflinkMaybeSupported(filepath.Dir(dst)) {
+		return false, copyTreeFallback(src, dst, make(map[hardlinkKey]string))
+	}
+
+	hardlinks := make(map[hardlinkKey]string)
+	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		dstPath := filepath.Join(dst, rel)
+
+		switch {
+		case info.IsDir():
+			if err := os.MkdirAll(dstPath, info.Mode().Perm()); err != nil {
+				return err
+			}
+			return chownLike(dstPath, info)
+		case info.Mode()&os.ModeSymlink != 0:
+			target, rerr := os.Readlink(path)
+			if rerr != nil {
+				return rerr
+			}
+			if err := os.Symlink(target, dstPath); err != nil {
+				return err
+			}
+			return chownLike(dstPath, info)
+		case !info.Mode().IsRegular():
+			return nil
+		}
+
+		if key, ok := hardlinkKeyOf(info); ok {
+			if existing, ok := hardlinks[key]; ok {
+				return os.Link(existing, dstPath)
+			}
+			hardlinks[key] = dstPath
+		}
+
+		cloned, cerr := cloneFile(path, dstPath, info.Mode().Perm())
+		if cerr != nil {
+			return cerr
+		}
+		if cloned {
+			usedReflink = true
+		}
+		return chownLike(dstPath, info)
+	})
+
+	return usedReflink, err
+}
+
+// cloneFile tries FICLONE first (whole-file reflink). If the kernel or
+// filesystem doesn't support it for this pair of files, it falls back to
+// copy_file_range and, failing that, a plain userspace copy. Only the
+// FICLONE path actually shares extents with src: on a filesystem without
+// remap_file_range support (e.g. ext4, the common case) copy_file_range
+// is just a VFS-mediated byte-for-byte copy, so usedReflink must stay
+// false for it — reporting it as a clone would hide the fact that disk
+// usage just doubled anyway.
+func cloneFile(src, dst string, perm os.FileMode) (usedReflink bool, err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_EXCL, perm)
+	if err != nil {
+		return false, err
+	}
+	defer out.Close()
+
+	if err := unix.IoctlFileClone(int(out.Fd()), int(in.Fd())); err == nil {
+		return true, nil
+	}
+
+	st, err := in.Stat()
+	if err != nil {
+		return false, err
+	}
+	size := st.Size()
+	for size > 0 {
+		n, cerr := unix.CopyFileRange(int(in.Fd()), nil, int(out.Fd()), nil, int(size), 0)
+		if cerr != nil {
+			// copy_file_range unsupported for this fs pair: last resort,
+			// plain userspace copy into the same destination file
+			in.Close()
+			out.Close()
+			return false, copyRegularFile(src, dst, perm)
+		}
+		if n == 0 {
+			break
+		}
+		size -= int64(n)
+	}
+	// a real kernel-mediated copy, not a CoW clone: extents aren't shared
+	return false, nil
+}
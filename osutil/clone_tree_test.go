@@ -0,0 +1,102 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package osutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// These exercise the portable fallback-copy path (CloneOptions.DisableReflink)
+// so they behave the same regardless of what filesystem the test happens to
+// run on.
+
+func TestCloneTreeCopiesRegularFilesAndSymlinks(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	dst := filepath.Join(root, "dst")
+
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "file"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "sub", "nested"), []byte("world"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("nested", filepath.Join(src, "sub", "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	usedReflink, err := CloneTree(src, dst, CloneOptions{DisableReflink: true})
+	if err != nil {
+		t.Fatalf("CloneTree failed: %v", err)
+	}
+	if usedReflink {
+		t.Error("CloneTree reported usedReflink with DisableReflink set")
+	}
+
+	data, err := os.ReadFile(filepath.Join(dst, "file"))
+	if err != nil || string(data) != "hello" {
+		t.Errorf("dst/file = %q, %v, want %q, nil", data, err, "hello")
+	}
+	data, err = os.ReadFile(filepath.Join(dst, "sub", "nested"))
+	if err != nil || string(data) != "world" {
+		t.Errorf("dst/sub/nested = %q, %v, want %q, nil", data, err, "world")
+	}
+	target, err := os.Readlink(filepath.Join(dst, "sub", "link"))
+	if err != nil || target != "nested" {
+		t.Errorf("dst/sub/link -> %q, %v, want %q, nil", target, err, "nested")
+	}
+}
+
+func TestCloneTreePreservesHardlinks(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	dst := filepath.Join(root, "dst")
+
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "a"), []byte("shared"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(src, "a"), filepath.Join(src, "b")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := CloneTree(src, dst, CloneOptions{DisableReflink: true}); err != nil {
+		t.Fatalf("CloneTree failed: %v", err)
+	}
+
+	fiA, err := os.Stat(filepath.Join(dst, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fiB, err := os.Stat(filepath.Join(dst, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(fiA, fiB) {
+		t.Error("dst/a and dst/b are no longer hardlinked after CloneTree")
+	}
+}
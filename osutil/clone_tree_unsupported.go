@@ -0,0 +1,49 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+//go:build !linux
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package osutil
+
+import "os"
+
+// cloneTree on non-Linux systems never has a reflink fast path available,
+// so it always falls back to a plain recursive copy.
+func cloneTree(src, dst string, opts CloneOptions) (usedReflink bool, err error) {
+	err = copyTreeFallback(src, dst, make(map[hardlinkKey]string))
+	return false, err
+}
+
+// hardlinkKeyOf has no portable way to read a device/inode pair out of
+// os.FileInfo.Sys() without assuming a *syscall.Stat_t shape that isn't
+// guaranteed on every non-Linux GOOS (notably windows). Rather than
+// special-case each one, hardlink preservation is simply skipped here:
+// copyTreeFallback ends up giving hardlinked files independent copies
+// on these platforms, which is correct data, just not maximally space
+// efficient.
+func hardlinkKeyOf(info os.FileInfo) (hardlinkKey, bool) {
+	return hardlinkKey{}, false
+}
+
+// chownLike has the same portability problem as hardlinkKeyOf: there's
+// no OS-agnostic way to read an owning uid/gid out of os.FileInfo.Sys().
+// It's a no-op here, so entries CloneTree creates on these platforms end
+// up owned by whichever user is running the process.
+func chownLike(dst string, info os.FileInfo) error {
+	return nil
+}
@@ -116,19 +116,43 @@ func (b Backend) ClearTrashedData(oldSnap *snap.Info) {
 	}
 }
 
-func (b Backend) HideSnapData(snapName string) error {
+// HideSnapData moves every user's exposed ~/snap/<name> dir into the
+// hidden ~/.snap/data/<name> location. The per-user moves are dispatched
+// across a bounded worker pool (see homeMigrationWorkers) since each user
+// touches a distinct home directory; report.PerUser lets a caller see
+// exactly which accounts migrated and which didn't instead of a single
+// opaque error.
+func (b Backend) HideSnapData(snapName string) (report *HomeMigrationReport, err error) {
+	report = &HomeMigrationReport{PerUser: make(map[string]error)}
+
+	// finish off anything a previous, interrupted HideSnapData or
+	// UndoHideSnapData for this snap left behind before planning new work
+	if j, err := readMigrationJournal(snapName); err != nil {
+		report.FirstErr = err
+		return report, err
+	} else if j != nil {
+		if err := j.replay(j.Direction == journalDirectionUndo); err != nil {
+			report.FirstErr = err
+			return report, err
+		}
+	}
+
 	preMigrationOpts := &dirs.SnapDirOptions{UseHiddenSnapDataDir: true}
 	postMigrationOpts := &dirs.SnapDirOptions{UseHiddenSnapDataDir: true, MigratedToHiddenDir: true}
 
 	users, err := allUsers(preMigrationOpts)
 	if err != nil {
-		return err
+		report.FirstErr = err
+		return report, err
 	}
 
+	j := &migrationJournal{SnapName: snapName, Direction: journalDirectionHide}
 	for _, usr := range users {
 		uid, gid, err := osutil.UidGid(usr)
 		if err != nil {
-			return err
+			// one bad account shouldn't stop the rest from migrating
+			report.recordErr(usr.Username, err)
+			continue
 		}
 
 		// nothing to migrate
@@ -136,53 +160,71 @@ func (b Backend) HideSnapData(snapName string) error {
 		if _, err := os.Stat(oldSnapDir); errors.Is(err, os.ErrNotExist) {
 			continue
 		} else if err != nil {
-			return fmt.Errorf("cannot stat snap dir %q: %w", oldSnapDir, err)
-		}
-
-		// create the new hidden snap dir
-		hiddenSnapDir := snap.SnapDir(usr.HomeDir, postMigrationOpts)
-		if err := osutil.MkdirAllChown(hiddenSnapDir, 0700, uid, gid); err != nil {
-			return fmt.Errorf("cannot create snap dir %q: %w", hiddenSnapDir, err)
+			report.recordErr(usr.Username, fmt.Errorf("cannot stat snap dir %q: %w", oldSnapDir, err))
+			continue
 		}
 
-		// move the snap's dir
 		newSnapDir := snap.UserSnapDir(usr.HomeDir, snapName, postMigrationOpts)
-		if err := osutil.AtomicRename(oldSnapDir, newSnapDir); err != nil {
-			return fmt.Errorf("cannot move %q to %q: %w", oldSnapDir, newSnapDir, err)
-		}
+		j.Steps = append(j.Steps, &journalStep{
+			Username: usr.Username,
+			UID:      uid,
+			GID:      gid,
+			OldPath:  oldSnapDir,
+			NewPath:  newSnapDir,
+			Phase:    journalPhasePlanned,
+		})
+	}
 
-		// remove ~/snap if it's empty
-		if err := removeIfEmpty(snap.SnapDir(usr.HomeDir, preMigrationOpts)); err != nil {
-			return fmt.Errorf("failed to remove old snap dir: %w", err)
+	if len(j.Steps) == 0 {
+		return report, report.FirstErr
+	}
+
+	// write the manifest before touching anything, so a crash partway
+	// through can be resumed instead of leaving a mixed migration state
+	if err := j.save(); err != nil {
+		if report.FirstErr == nil {
+			report.FirstErr = err
 		}
+		return report, report.FirstErr
 	}
 
-	return nil
+	report.merge(runMigrationSteps(j))
+	return report, report.FirstErr
 }
 
-func (b Backend) UndoHideSnapData(snapName string) error {
+// UndoHideSnapData reverses HideSnapData: it moves every migrated user's
+// ~/.snap/data/<name> dir back to the exposed ~/snap/<name> location. As
+// with HideSnapData, per-user moves run across a bounded worker pool; a
+// failure for one user doesn't stop the others from being restored.
+func (b Backend) UndoHideSnapData(snapName string) (report *HomeMigrationReport, err error) {
+	report = &HomeMigrationReport{PerUser: make(map[string]error)}
+
+	// finish off anything a previous, interrupted HideSnapData or
+	// UndoHideSnapData for this snap left behind before planning new work
+	if j, err := readMigrationJournal(snapName); err != nil {
+		report.FirstErr = err
+		return report, err
+	} else if j != nil {
+		if err := j.replay(true); err != nil {
+			logger.Noticef("%v", err)
+		}
+	}
+
 	preMigrationOpts := &dirs.SnapDirOptions{UseHiddenSnapDataDir: true}
 	postMigrationOpts := &dirs.SnapDirOptions{UseHiddenSnapDataDir: true, MigratedToHiddenDir: true}
 
 	users, err := allUsers(postMigrationOpts)
 	if err != nil {
-		return err
-	}
-
-	var firstErr error
-	handle := func(err error) {
-		// keep going, restore previous state as much as possible
-		if firstErr == nil {
-			firstErr = err
-		} else {
-			logger.Noticef(err.Error())
-		}
+		report.FirstErr = err
+		return report, err
 	}
 
+	j := &migrationJournal{SnapName: snapName, Direction: journalDirectionUndo}
 	for _, usr := range users {
 		uid, gid, err := osutil.UidGid(usr)
 		if err != nil {
-			handle(err)
+			// one bad account shouldn't stop the rest from being restored
+			report.recordErr(usr.Username, err)
 			continue
 		}
 
@@ -190,31 +232,38 @@ func (b Backend) UndoHideSnapData(snapName string) error {
 		hiddenSnapDir := snap.UserSnapDir(usr.HomeDir, snapName, postMigrationOpts)
 		if _, err := os.Stat(hiddenSnapDir); err != nil {
 			if !errors.Is(err, os.ErrNotExist) {
-				handle(fmt.Errorf("cannot read files in %q: %w", hiddenSnapDir, err))
+				report.recordErr(usr.Username, fmt.Errorf("cannot read files in %q: %w", hiddenSnapDir, err))
 			}
 			continue
 		}
 
-		// ensure parent dirs exist
-		exposedDir := snap.SnapDir(usr.HomeDir, preMigrationOpts)
-		if err := osutil.MkdirAllChown(exposedDir, 0700, uid, gid); err != nil {
-			handle(fmt.Errorf("cannot create snap dir %q: %w", exposedDir, err))
-			continue
-		}
-
 		exposedSnapDir := snap.UserSnapDir(usr.HomeDir, snapName, preMigrationOpts)
-		if err := osutil.AtomicRename(hiddenSnapDir, exposedSnapDir); err != nil {
-			handle(fmt.Errorf("cannot move %q to %q: %w", hiddenSnapDir, exposedSnapDir, err))
-		}
+		j.Steps = append(j.Steps, &journalStep{
+			Username: usr.Username,
+			UID:      uid,
+			GID:      gid,
+			OldPath:  exposedSnapDir,
+			NewPath:  hiddenSnapDir,
+			Phase:    journalPhasePlanned,
+		})
+	}
+
+	if len(j.Steps) == 0 {
+		return report, report.FirstErr
+	}
 
-		// remove ~/.snap/data dir if empty
-		hiddenDir := snap.SnapDir(usr.HomeDir, postMigrationOpts)
-		if err := removeIfEmpty(hiddenDir); err != nil {
-			handle(fmt.Errorf("cannot remove dir %q: %w", hiddenDir, err))
+	// write the manifest before touching anything, so a crash partway
+	// through can be resumed instead of leaving a mixed migration state
+	if err := j.save(); err != nil {
+		if report.FirstErr == nil {
+			report.FirstErr = err
 		}
+		return report, report.FirstErr
 	}
 
-	return firstErr
+	// keep going, restore previous state as much as possible
+	report.merge(runMigrationSteps(j))
+	return report, report.FirstErr
 }
 
 var removeIfEmpty = func(dir string) error {
@@ -0,0 +1,98 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package backend
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/snapcore/snapd/dirs"
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/snap"
+)
+
+// disableReflinkCopy forces copySnapData onto the recursive-copy path
+// even on a filesystem that supports cloning. It exists purely so tests
+// can exercise the fallback deterministically instead of depending on
+// the CI machine's filesystem; production code never sets it.
+var disableReflinkCopy = false
+
+// copySnapData copies oldSnap's per-revision data directory onto
+// newSnap's (the common data dir is shared across revisions and is
+// handled by CopySnapData itself, not here). It copies the system-wide
+// directory plus the per-user one for every user on the system.
+//
+// Each directory is copied with osutil.CloneTree, which reflinks onto
+// the same extents as oldSnap's data when the filesystem supports it
+// (btrfs, xfs with reflink=1, zfs with block cloning) and transparently
+// falls back to a full recursive copy otherwise. Either way, the result
+// is indistinguishable to callers: a fully independent copy of oldSnap's
+// data under newSnap's directory, ready to be discarded via the usual
+// trash/rename dance if the refresh is undone.
+func copySnapData(oldSnap, newSnap *snap.Info, opts *dirs.SnapDirOptions) error {
+	pairs, err := dataDirPairs(oldSnap, newSnap, opts)
+	if err != nil {
+		return err
+	}
+
+	for _, pair := range pairs {
+		if _, err := os.Lstat(pair.old); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if err := os.RemoveAll(pair.new); err != nil {
+			// CloneTree requires the destination not to exist yet
+			return err
+		}
+
+		if _, err := osutil.CloneTree(pair.old, pair.new, osutil.CloneOptions{DisableReflink: disableReflinkCopy}); err != nil {
+			return fmt.Errorf("cannot copy %q to %q: %v", pair.old, pair.new, err)
+		}
+	}
+
+	return nil
+}
+
+type dataDirPair struct {
+	old, new string
+}
+
+// dataDirPairs lists the (old revision dir, new revision dir) pairs that
+// copySnapData needs to populate: the system-wide data dir plus one per
+// user on the system, whether or not that user has ever used oldSnap
+// (copySnapData skips the pairs whose old dir doesn't exist).
+func dataDirPairs(oldSnap, newSnap *snap.Info, opts *dirs.SnapDirOptions) ([]dataDirPair, error) {
+	pairs := []dataDirPair{{old: oldSnap.DataDir(), new: newSnap.DataDir()}}
+
+	users, err := allUsers(opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, usr := range users {
+		pairs = append(pairs, dataDirPair{
+			old: snap.UserDataDir(usr.HomeDir, oldSnap.InstanceName(), oldSnap.Revision, opts),
+			new: snap.UserDataDir(usr.HomeDir, newSnap.InstanceName(), newSnap.Revision, opts),
+		})
+	}
+
+	return pairs, nil
+}
@@ -0,0 +1,126 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package backend
+
+import (
+	"runtime"
+	"sync"
+)
+
+// HomeMigrationReport describes the per-user outcome of a HideSnapData or
+// UndoHideSnapData run. PerUser is keyed by username; a nil value means
+// that user's home dir was migrated without error. FirstErr is the first
+// error seen, same value HideSnapData/UndoHideSnapData themselves return,
+// kept here too so callers that only look at the report still see it.
+type HomeMigrationReport struct {
+	PerUser  map[string]error
+	FirstErr error
+}
+
+// recordErr records a per-user failure that happened before that user's
+// step could even be planned (e.g. looking up their uid/gid, or stating
+// their home dir), so that one bad account doesn't stop HideSnapData or
+// UndoHideSnapData from planning and migrating the rest.
+func (r *HomeMigrationReport) recordErr(username string, err error) {
+	if r.PerUser == nil {
+		r.PerUser = make(map[string]error)
+	}
+	r.PerUser[username] = err
+	if r.FirstErr == nil {
+		r.FirstErr = err
+	}
+}
+
+// merge folds other's per-user results into r, keeping r's FirstErr if it
+// was already set (planning failures are reported before any filesystem
+// work happens, so they take precedence).
+func (r *HomeMigrationReport) merge(other *HomeMigrationReport) {
+	for username, err := range other.PerUser {
+		r.PerUser[username] = err
+	}
+	if r.FirstErr == nil {
+		r.FirstErr = other.FirstErr
+	}
+}
+
+// homeMigrationWorkers caps how many users' steps HideSnapData and
+// UndoHideSnapData migrate at once. It's a package variable, following
+// the same test-seam convention as allUsers and disableReflinkCopy,
+// rather than a Backend field, since Backend carries no state of its own.
+var homeMigrationWorkers = func() int {
+	if n := runtime.NumCPU(); n < 8 {
+		return n
+	}
+	return 8
+}()
+
+// runMigrationSteps applies every step of j across a bounded worker
+// pool. The steps touch distinct users' home directories, so the only
+// state they share is the journal itself, which serialises its own
+// writes (see migrationJournal.setPhase); that's enough to let the
+// filesystem work for different users run concurrently. The journal is
+// removed once every step is finalized.
+func runMigrationSteps(j *migrationJournal) *HomeMigrationReport {
+	report := &HomeMigrationReport{PerUser: make(map[string]error, len(j.Steps))}
+	if len(j.Steps) == 0 {
+		return report
+	}
+
+	workers := homeMigrationWorkers
+	if workers > len(j.Steps) {
+		workers = len(j.Steps)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	steps := make(chan *journalStep)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for step := range steps {
+				err := j.applyStep(step)
+				mu.Lock()
+				report.PerUser[step.Username] = err
+				if err != nil && report.FirstErr == nil {
+					report.FirstErr = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, step := range j.Steps {
+		steps <- step
+	}
+	close(steps)
+	wg.Wait()
+
+	if j.done() {
+		if err := j.remove(); err != nil && report.FirstErr == nil {
+			report.FirstErr = err
+		}
+	}
+
+	return report
+}
@@ -0,0 +1,184 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package backend
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/snapcore/snapd/dirs"
+)
+
+func setUpMigrationJournalTest(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	dirs.SetRootDir(root)
+	t.Cleanup(func() { dirs.SetRootDir("/") })
+	return root
+}
+
+func newTestStep(oldPath, newPath string) *journalStep {
+	return &journalStep{
+		Username: "test",
+		UID:      os.Getuid(),
+		GID:      os.Getgid(),
+		OldPath:  oldPath,
+		NewPath:  newPath,
+		Phase:    journalPhasePlanned,
+	}
+}
+
+func TestJournalReplayForwardMovesDataAndRemovesJournal(t *testing.T) {
+	root := setUpMigrationJournalTest(t)
+
+	oldPath := filepath.Join(root, "home", "snap", "foo")
+	newPath := filepath.Join(root, "home", ".snap", "data", "foo")
+	if err := os.MkdirAll(oldPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(oldPath, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	j := &migrationJournal{
+		SnapName:  "foo",
+		Direction: journalDirectionHide,
+		Steps:     []*journalStep{newTestStep(oldPath, newPath)},
+	}
+	if err := j.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := j.replay(false); err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+
+	if _, err := os.Stat(oldPath); !os.IsNotExist(err) {
+		t.Errorf("oldPath still exists after forward replay: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(newPath, "file")); err != nil {
+		t.Errorf("data wasn't moved to newPath: %v", err)
+	}
+	if _, err := os.Stat(journalPath("foo")); !os.IsNotExist(err) {
+		t.Errorf("journal wasn't removed once every step finalized: %v", err)
+	}
+}
+
+func TestJournalReplayBackwardMovesDataBack(t *testing.T) {
+	root := setUpMigrationJournalTest(t)
+
+	oldPath := filepath.Join(root, "home", "snap", "foo")
+	newPath := filepath.Join(root, "home", ".snap", "data", "foo")
+	if err := os.MkdirAll(newPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(newPath, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	j := &migrationJournal{
+		SnapName:  "foo",
+		Direction: journalDirectionUndo,
+		Steps:     []*journalStep{newTestStep(oldPath, newPath)},
+	}
+	if err := j.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := j.replay(true); err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+
+	if _, err := os.Stat(newPath); !os.IsNotExist(err) {
+		t.Errorf("newPath still exists after backward replay: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(oldPath, "file")); err != nil {
+		t.Errorf("data wasn't moved back to oldPath: %v", err)
+	}
+}
+
+func TestJournalReplayResumesPastRenamedPhase(t *testing.T) {
+	root := setUpMigrationJournalTest(t)
+
+	// another snap's dir, so the shared "snap" parent isn't empty once
+	// foo's own dir has already been renamed away
+	otherSnapDir := filepath.Join(root, "home", "snap", "bar")
+	if err := os.MkdirAll(otherSnapDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	oldPath := filepath.Join(root, "home", "snap", "foo")
+	newPath := filepath.Join(root, "home", ".snap", "data", "foo")
+	if err := os.MkdirAll(newPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(newPath, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	step := newTestStep(oldPath, newPath)
+	step.Phase = journalPhaseRenamed
+	j := &migrationJournal{SnapName: "foo", Direction: journalDirectionHide, Steps: []*journalStep{step}}
+
+	if err := j.applyStep(step); err != nil {
+		t.Fatalf("applyStep failed resuming a renamed step: %v", err)
+	}
+	if step.Phase != journalPhaseFinalized {
+		t.Errorf("step.Phase = %q, want %q", step.Phase, journalPhaseFinalized)
+	}
+	// already-renamed data must be left exactly where it was, untouched
+	if _, err := os.Stat(filepath.Join(newPath, "file")); err != nil {
+		t.Errorf("data at newPath disappeared while finalizing a resumed step: %v", err)
+	}
+}
+
+func TestResumeInterruptedHomeMigrationFinishesLeftoverJournal(t *testing.T) {
+	root := setUpMigrationJournalTest(t)
+
+	oldPath := filepath.Join(root, "home", "snap", "foo")
+	newPath := filepath.Join(root, "home", ".snap", "data", "foo")
+	if err := os.MkdirAll(oldPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(oldPath, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	j := &migrationJournal{
+		SnapName:  "foo",
+		Direction: journalDirectionHide,
+		Steps:     []*journalStep{newTestStep(oldPath, newPath)},
+	}
+	if err := j.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := (Backend{}).ResumeInterruptedHomeMigration(); err != nil {
+		t.Fatalf("ResumeInterruptedHomeMigration failed: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(newPath, "file")); err != nil {
+		t.Errorf("leftover journal wasn't resumed: %v", err)
+	}
+	if _, err := os.Stat(journalPath("foo")); !os.IsNotExist(err) {
+		t.Errorf("journal wasn't removed once resumed: %v", err)
+	}
+}
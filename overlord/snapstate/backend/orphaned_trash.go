@@ -0,0 +1,185 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package backend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/snapcore/snapd/dirs"
+	"github.com/snapcore/snapd/snap"
+)
+
+// trashSuffix is appended to a snap data directory when clearTrash moves
+// it aside instead of removing it outright (see trash.go). A directory
+// ending in trashSuffix is, by construction, never live data.
+const trashSuffix = ".old"
+
+// orphanSweepParents returns every directory that directly contains
+// per-snap data directories, in both the exposed and the hidden ("~/.snap
+// /data") layout: the global /var/snap parent plus the equivalent
+// per-user parent for every user on the system.
+func orphanSweepParents() ([]string, error) {
+	parents := []string{dirs.SnapDataDir}
+
+	layouts := []*dirs.SnapDirOptions{
+		{},
+		{UseHiddenSnapDataDir: true, MigratedToHiddenDir: true},
+	}
+	for _, opts := range layouts {
+		users, err := allUsers(opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, usr := range users {
+			parents = append(parents, snap.SnapDir(usr.HomeDir, opts))
+		}
+	}
+
+	return parents, nil
+}
+
+// SweepOrphanedTrash walks every snap-data parent directory (global and
+// per-user, exposed and hidden layout) and removes any *.old trash entry
+// whose owning snap is not in knownSnaps, or whose revision no longer
+// matches the one knownSnaps has on disk. It never touches a directory
+// that isn't trash, so the live, current revision's data is always left
+// alone.
+//
+// TODO: this request asked for it to self-heal long-running systems by
+// running on a periodic tick of the snapstate ensure loop, but that
+// manager isn't part of this change, so nothing calls SweepOrphanedTrash
+// yet; it's only reachable by a future caller passing it the current set
+// of installed snaps. Until that's wired up, trash left behind by an
+// aborted refresh, a crash during UndoCopySnapData, or a snap removed
+// while its trash still existed is not reaped on its own.
+func (b Backend) SweepOrphanedTrash(knownSnaps map[string]*snap.Info) (removed []string, err error) {
+	parents, err := orphanSweepParents()
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []string
+	for _, parent := range parents {
+		entries, err := ioutil.ReadDir(parent)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			errs = append(errs, err.Error())
+			continue
+		}
+
+		for _, entry := range entries {
+			if !strings.HasSuffix(entry.Name(), trashSuffix) {
+				// either a live snap dir, or a snap dir holding its own
+				// revision/common trash entries a level down
+				sub, err := sweepSnapDataDir(filepath.Join(parent, entry.Name()), entry.Name(), knownSnaps)
+				if err != nil {
+					errs = append(errs, err.Error())
+				}
+				removed = append(removed, sub...)
+				continue
+			}
+
+			// the whole per-snap data dir was trashed (e.g. the snap was
+			// removed before its trash could be cleared)
+			snapName := strings.TrimSuffix(entry.Name(), trashSuffix)
+			if _, ok := knownSnaps[snapName]; ok {
+				continue
+			}
+			path := filepath.Join(parent, entry.Name())
+			if err := os.RemoveAll(path); err != nil {
+				errs = append(errs, fmt.Errorf("cannot remove orphaned trash %q: %w", path, err).Error())
+				continue
+			}
+			removed = append(removed, path)
+		}
+	}
+
+	if len(errs) > 0 {
+		return removed, fmt.Errorf("cannot sweep orphaned trash: %s", strings.Join(errs, "; "))
+	}
+	return removed, nil
+}
+
+// sweepSnapDataDir looks for revision/common *.old entries directly under
+// a single snap's data directory and removes the ones that are orphaned:
+// either the snap isn't known at all, or the entry isn't a common-data
+// trash and its revision doesn't match the revision knownSnaps has on
+// disk for that snap.
+func sweepSnapDataDir(dir, snapName string, knownSnaps map[string]*snap.Info) (removed []string, err error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	info, known := knownSnaps[snapName]
+
+	var errs []string
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), trashSuffix) {
+			continue
+		}
+		base := strings.TrimSuffix(entry.Name(), trashSuffix)
+
+		if known {
+			rev, isRevision := parseRevisionTrash(base)
+			switch {
+			case !isRevision:
+				// common-data trash: there's no "current" marker for it
+				// besides the snap still being installed, so as long as
+				// the snap is known it's left for clearTrash/untrashData
+				continue
+			case rev == info.Revision:
+				// trash for the currently installed revision: leave it
+				// for clearTrash/untrashData to deal with
+				continue
+			}
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		if err := os.RemoveAll(path); err != nil {
+			errs = append(errs, fmt.Errorf("cannot remove orphaned trash %q: %w", path, err).Error())
+			continue
+		}
+		removed = append(removed, path)
+	}
+
+	if len(errs) > 0 {
+		return removed, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return removed, nil
+}
+
+func parseRevisionTrash(name string) (snap.Revision, bool) {
+	// snap.ParseRevision also accepts local revisions ("x1")
+	rev, err := snap.ParseRevision(name)
+	if err != nil {
+		return snap.Revision{}, false
+	}
+	return rev, true
+}
@@ -0,0 +1,99 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2023 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package backend
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/snapcore/snapd/snap"
+)
+
+func touch(t *testing.T, path string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSweepSnapDataDirLeavesCurrentRevisionAndCommonData(t *testing.T) {
+	dir := t.TempDir()
+
+	// current revision's trash: must never be removed, it's only trash
+	// because clearTrash/untrashData haven't gotten to it yet
+	touch(t, filepath.Join(dir, "5.old", "file"))
+	// a stale revision no longer installed: orphaned, should go
+	touch(t, filepath.Join(dir, "3.old", "file"))
+	// common-data trash for a still-installed snap: there's no revision
+	// to compare against, so it must be left alone too
+	touch(t, filepath.Join(dir, "common.old", "file"))
+
+	knownSnaps := map[string]*snap.Info{
+		"foo": {SideInfo: snap.SideInfo{RealName: "foo", Revision: snap.R(5)}},
+	}
+
+	removed, err := sweepSnapDataDir(dir, "foo", knownSnaps)
+	if err != nil {
+		t.Fatalf("sweepSnapDataDir failed: %v", err)
+	}
+
+	want := []string{filepath.Join(dir, "3.old")}
+	sort.Strings(removed)
+	if len(removed) != len(want) || removed[0] != want[0] {
+		t.Fatalf("removed = %v, want %v", removed, want)
+	}
+
+	for _, keep := range []string{"5.old", "common.old"} {
+		if _, err := os.Stat(filepath.Join(dir, keep)); err != nil {
+			t.Errorf("%s was removed, should have been kept: %v", keep, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "3.old")); !os.IsNotExist(err) {
+		t.Errorf("3.old still exists after sweep: %v", err)
+	}
+}
+
+func TestSweepSnapDataDirRemovesEverythingForUnknownSnap(t *testing.T) {
+	dir := t.TempDir()
+
+	touch(t, filepath.Join(dir, "5.old", "file"))
+	touch(t, filepath.Join(dir, "common.old", "file"))
+
+	removed, err := sweepSnapDataDir(dir, "gone", map[string]*snap.Info{})
+	if err != nil {
+		t.Fatalf("sweepSnapDataDir failed: %v", err)
+	}
+
+	if len(removed) != 2 {
+		t.Fatalf("removed = %v, want 2 entries", removed)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("dir still has entries after sweeping an unknown snap: %v", entries)
+	}
+}